@@ -0,0 +1,229 @@
+// Copyright 2022 The prometheus-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package operator
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/loki/pkg/logql"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+	"gopkg.in/yaml.v3"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+)
+
+// RuleConfigurationFormat identifies the on-disk layout that
+// generateRulesConfiguration renders a PrometheusRuleSpec into, and the
+// expression language ValidateRule checks `expr` fields against.
+type RuleConfigurationFormat int
+
+const (
+	// PrometheusFormat renders rules the way the Prometheus rule manager
+	// loads them: a plain `groups:` document, stripped of any
+	// Thanos-specific extensions.
+	PrometheusFormat RuleConfigurationFormat = iota
+	// ThanosFormat renders rules for the Thanos ruler, which additionally
+	// understands `partial_response_strategy` at the group level.
+	ThanosFormat
+	// LokiRulerFormat renders rules for a Loki ruler sidecar. The group
+	// and rule layout is unchanged, but `expr` is validated as LogQL
+	// rather than PromQL, and `partial_response_strategy` is dropped since
+	// the Loki ruler doesn't understand it.
+	LokiRulerFormat
+	// MimirRulerFormat renders rules for a Mimir ruler. Mimir speaks the
+	// same PromQL dialect as Prometheus/Thanos, so `expr` is validated as
+	// PromQL; the tenant scoping and `partial_response_strategy` stripping
+	// behave like LokiRulerFormat.
+	MimirRulerFormat
+)
+
+// admissionError pairs a rule validation failure with the field path
+// (`groups[i]` or `groups[i].rules[j]`) responsible for it, so that
+// ValidateRule's callers - the admission webhook and
+// generateRulesConfiguration - can report exactly which rule is at fault.
+// Line, Column and Snippet are best-effort: they're populated when the
+// underlying error carries a parser position (PromQL parse errors, or a
+// YAML node position resolved by ValidateRuleYAML) and left zero
+// otherwise. LogQL parse errors don't populate them.
+type admissionError struct {
+	err     error
+	Field   string
+	Line    int
+	Column  int
+	Snippet string
+}
+
+func (e admissionError) Error() string {
+	return e.err.Error()
+}
+
+func newAdmissionError(field string, err error) admissionError {
+	return admissionError{Field: field, err: err}
+}
+
+// parseErrPosition extracts the 1-based line and column a PromQL parse
+// error points at, relative to the expression text that was parsed.
+// *parser.ParseErr only carries a byte offset (PositionRange.Start) into
+// Query, so the line/column have to be derived by counting newlines up
+// to that offset, the same way (*parser.ParseErr).Error() does it.
+func parseErrPosition(err error) (line, column int, ok bool) {
+	perr, ok := err.(*parser.ParseErr)
+	if !ok {
+		return 0, 0, false
+	}
+
+	pos := int(perr.PositionRange.Start)
+	if pos < 0 || pos > len(perr.Query) {
+		return 1, 1, true
+	}
+
+	before := perr.Query[:pos]
+	line = 1 + strings.Count(before, "\n")
+	column = pos + 1
+	if nl := strings.LastIndex(before, "\n"); nl >= 0 {
+		column = pos - nl
+	}
+
+	return line, column, true
+}
+
+// newExprAdmissionError builds the admissionError for a failed `expr`
+// parse, filling in Line/Column/Snippet when err carries a parser
+// position.
+func newExprAdmissionError(field, expr string, err error) admissionError {
+	admErr := newAdmissionError(field, err)
+	if line, column, ok := parseErrPosition(err); ok {
+		admErr.Line, admErr.Column, admErr.Snippet = line, column, expr
+	}
+	return admErr
+}
+
+// ValidateRule validates ruleSpec and returns the list of validation
+// errors found, if any. format determines which expression language
+// `expr` fields are parsed as: LokiRulerFormat uses the LogQL parser,
+// every other format uses the PromQL parser.
+func ValidateRule(format RuleConfigurationFormat, ruleSpec monitoringv1.PrometheusRuleSpec) []admissionError {
+	var errs []admissionError
+
+	names := map[string]struct{}{}
+	duplicate := false
+	for _, group := range ruleSpec.Groups {
+		if _, found := names[group.Name]; found {
+			duplicate = true
+		}
+		names[group.Name] = struct{}{}
+	}
+	if duplicate {
+		errs = append(errs, newAdmissionError("groups", fmt.Errorf("group names need to be unique")))
+	}
+
+	for i, group := range ruleSpec.Groups {
+		if group.PartialResponseStrategy != "" {
+			if _, err := parsePartialResponseStrategy(group.PartialResponseStrategy); err != nil {
+				errs = append(errs, newAdmissionError(fmt.Sprintf("groups[%d].partial_response_strategy", i), err))
+			}
+		}
+
+		for j, rule := range group.Rules {
+			field := fmt.Sprintf("groups[%d].rules[%d]", i, j)
+
+			for name := range rule.Labels {
+				if !model.LabelName(name).IsValid() {
+					errs = append(errs, newAdmissionError(field, fmt.Errorf("invalid label name %q", name)))
+				}
+			}
+
+			if err := validateExpr(format, rule.Expr.String()); err != nil {
+				errs = append(errs, newExprAdmissionError(field, rule.Expr.String(), err))
+			}
+		}
+	}
+
+	return errs
+}
+
+// validateExpr parses expr with the expression language format expects,
+// preserving the distinction between alerting and recording rule
+// semantics is left to the caller - only syntax is checked here.
+func validateExpr(format RuleConfigurationFormat, expr string) error {
+	if format == LokiRulerFormat {
+		_, err := logql.ParseExpr(expr)
+		return err
+	}
+
+	_, err := parser.ParseExpr(expr)
+	return err
+}
+
+func parsePartialResponseStrategy(s string) (string, error) {
+	switch s {
+	case "warn", "abort":
+		return s, nil
+	default:
+		return "", fmt.Errorf("invalid partial_response_strategy %q, must be one of \"warn\" or \"abort\"", s)
+	}
+}
+
+// generateRulesConfiguration marshals ruleSpec into the on-disk layout
+// that format expects, refusing to render anything if ValidateRule finds
+// the spec invalid. Prometheus, Loki and Mimir all drop
+// `partial_response_strategy` since it's a Thanos-only extension.
+//
+// tenant identifies the ruler tenant the rules belong to - in practice
+// the namespace of the owning PrometheusRule, since that's how
+// multi-tenant Loki/Mimir deployments are conventionally mapped from a
+// single Kubernetes cluster. It only affects LokiRulerFormat and
+// MimirRulerFormat: both rulers reject the bare `groups:` document
+// Prometheus/Thanos load, and instead expect it scoped under the tenant
+// it's being loaded for:
+//
+//	<tenant>:
+//	  groups:
+//	  - name: ...
+//	    rules: ...
+//
+// tenant is ignored for PrometheusFormat/ThanosFormat.
+func generateRulesConfiguration(format RuleConfigurationFormat, tenant string, ruleSpec monitoringv1.PrometheusRuleSpec, logger log.Logger) (string, error) {
+	if errs := ValidateRule(format, ruleSpec); len(errs) != 0 {
+		for _, err := range errs {
+			level.Debug(logger).Log("msg", "invalid rule", "field", err.Field, "err", err.err)
+		}
+		return "", fmt.Errorf("%d rule error(s)", len(errs))
+	}
+
+	if format != ThanosFormat {
+		for i := range ruleSpec.Groups {
+			ruleSpec.Groups[i].PartialResponseStrategy = ""
+		}
+	}
+
+	var content []byte
+	var err error
+	switch format {
+	case LokiRulerFormat, MimirRulerFormat:
+		content, err = yaml.Marshal(map[string]monitoringv1.PrometheusRuleSpec{tenant: ruleSpec})
+	default:
+		content, err = yaml.Marshal(ruleSpec)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal rules: %w", err)
+	}
+
+	return string(content), nil
+}
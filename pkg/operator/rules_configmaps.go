@@ -0,0 +1,169 @@
+// Copyright 2022 The prometheus-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package operator
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-kit/log"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+)
+
+const (
+	// MaxSecretSize is the Kubernetes apiserver's approximate ceiling on
+	// the size of a single Secret or ConfigMap object stored in etcd.
+	MaxSecretSize = 1024 * 1024
+
+	// DefaultMaxRuleGroupsPerConfigMap caps how many rule groups
+	// MakeRulesConfigMaps packs into a single rule file ConfigMap, so
+	// that the Prometheus/Thanos ruler's startup isn't dominated by
+	// parsing one giant file.
+	DefaultMaxRuleGroupsPerConfigMap = 20
+)
+
+// DefaultMaxConfigMapDataSize is the soft per-ConfigMap byte budget
+// MakeRulesConfigMaps packs rule groups against. It leaves headroom
+// under MaxSecretSize for the ConfigMap's other keys and metadata. It's
+// a var, not a const, because 0.45 * MaxSecretSize isn't integral and
+// Go constants can't truncate on conversion.
+var DefaultMaxConfigMapDataSize = int(0.45 * float64(MaxSecretSize))
+
+// RuleShardingOptions controls how MakeRulesConfigMaps bin-packs rule
+// groups across the ConfigMaps it generates. The zero value falls back
+// to DefaultMaxConfigMapDataSize and DefaultMaxRuleGroupsPerConfigMap.
+type RuleShardingOptions struct {
+	MaxConfigMapDataSize      int
+	MaxRuleGroupsPerConfigMap int
+}
+
+// RegisterRuleShardingFlags registers the --max-rules-configmap-bytes and
+// --max-rule-groups-per-configmap operator flags, storing the parsed
+// values into opts.
+func RegisterRuleShardingFlags(fs *flag.FlagSet, opts *RuleShardingOptions) {
+	fs.IntVar(&opts.MaxConfigMapDataSize, "max-rules-configmap-bytes", DefaultMaxConfigMapDataSize,
+		"Maximum size in bytes of a generated rule file ConfigMap before it is split across multiple ConfigMaps.")
+	fs.IntVar(&opts.MaxRuleGroupsPerConfigMap, "max-rule-groups-per-configmap", DefaultMaxRuleGroupsPerConfigMap,
+		"Maximum number of rule groups packed into a single generated rule file ConfigMap.")
+}
+
+// RuleConfigMap is a single generated rule file: the key it should be
+// stored under in the ConfigMap and its rendered YAML content.
+type RuleConfigMap struct {
+	Key     string
+	Content string
+}
+
+// ruleGroupUnit is one rule group from one rule file, together with its
+// serialized size, used while bin-packing groups across ConfigMaps.
+type ruleGroupUnit struct {
+	file  string
+	group monitoringv1.RuleGroup
+	size  int
+}
+
+// MakeRulesConfigMaps renders ruleFiles - keyed by rule file name - into
+// one or more ConfigMaps' worth of YAML, splitting them so that no single
+// ConfigMap exceeds opts.MaxConfigMapDataSize bytes or
+// opts.MaxRuleGroupsPerConfigMap rule groups. Groups are packed greedily
+// in the order they're encountered, so groups belonging to the same file
+// generally end up together unless a budget boundary falls between them.
+// A zero-valued opts falls back to the package defaults. A rule group
+// that alone exceeds the byte budget is reported as a structured
+// admission error pointing at `groups[i]` rather than silently truncated.
+// tenant is forwarded to generateRulesConfiguration and only matters for
+// LokiRulerFormat/MimirRulerFormat.
+func MakeRulesConfigMaps(format RuleConfigurationFormat, tenant string, ruleFiles map[string]monitoringv1.PrometheusRuleSpec, opts RuleShardingOptions, logger log.Logger) ([]RuleConfigMap, error) {
+	if opts.MaxConfigMapDataSize <= 0 {
+		opts.MaxConfigMapDataSize = DefaultMaxConfigMapDataSize
+	}
+	if opts.MaxRuleGroupsPerConfigMap <= 0 {
+		opts.MaxRuleGroupsPerConfigMap = DefaultMaxRuleGroupsPerConfigMap
+	}
+
+	files := make([]string, 0, len(ruleFiles))
+	for file := range ruleFiles {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	var units []ruleGroupUnit
+	for _, file := range files {
+		spec := ruleFiles[file]
+		for i, group := range spec.Groups {
+			content, err := generateRulesConfiguration(format, tenant, monitoringv1.PrometheusRuleSpec{Groups: []monitoringv1.RuleGroup{group}}, logger)
+			if err != nil {
+				return nil, fmt.Errorf("%s: failed to render group %q: %w", file, group.Name, err)
+			}
+
+			if len(content) > opts.MaxConfigMapDataSize {
+				return nil, newAdmissionError(
+					fmt.Sprintf("groups[%d]", i),
+					fmt.Errorf("%s: group %q is %d bytes, which exceeds the %d byte ConfigMap budget on its own", file, group.Name, len(content), opts.MaxConfigMapDataSize),
+				)
+			}
+
+			units = append(units, ruleGroupUnit{file: file, group: group, size: len(content)})
+		}
+	}
+
+	var (
+		shards    [][]ruleGroupUnit
+		shard     []ruleGroupUnit
+		shardSize int
+	)
+	for _, u := range units {
+		if len(shard) > 0 && (shardSize+u.size > opts.MaxConfigMapDataSize || len(shard) >= opts.MaxRuleGroupsPerConfigMap) {
+			shards = append(shards, shard)
+			shard, shardSize = nil, 0
+		}
+		shard = append(shard, u)
+		shardSize += u.size
+	}
+	if len(shard) > 0 {
+		shards = append(shards, shard)
+	}
+
+	var configMaps []RuleConfigMap
+	for i, shard := range shards {
+		groupsByFile := map[string][]monitoringv1.RuleGroup{}
+		var shardFiles []string
+		for _, u := range shard {
+			if _, ok := groupsByFile[u.file]; !ok {
+				shardFiles = append(shardFiles, u.file)
+			}
+			groupsByFile[u.file] = append(groupsByFile[u.file], u.group)
+		}
+		sort.Strings(shardFiles)
+
+		for _, file := range shardFiles {
+			content, err := generateRulesConfiguration(format, tenant, monitoringv1.PrometheusRuleSpec{Groups: groupsByFile[file]}, logger)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", file, err)
+			}
+
+			key := file
+			if len(shards) > 1 {
+				key = fmt.Sprintf("%s-%d.yaml", strings.TrimSuffix(file, ".yaml"), i)
+			}
+			configMaps = append(configMaps, RuleConfigMap{Key: key, Content: content})
+		}
+	}
+
+	return configMaps, nil
+}
@@ -0,0 +1,258 @@
+// Copyright 2022 The prometheus-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package operator
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/api"
+	apiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+)
+
+// RemoteRuleValidationMode controls whether ValidateRuleRemote executes
+// rules against a live Prometheus/Thanos query endpoint in addition to
+// the offline parser checks ValidateRule always runs.
+type RemoteRuleValidationMode string
+
+const (
+	// RemoteRuleValidationOff never contacts the query endpoint.
+	RemoteRuleValidationOff RemoteRuleValidationMode = "off"
+	// RemoteRuleValidationBestEffort contacts the query endpoint but
+	// treats it being unreachable as success, falling back to the
+	// offline ValidateRule result.
+	RemoteRuleValidationBestEffort RemoteRuleValidationMode = "best-effort"
+	// RemoteRuleValidationStrict contacts the query endpoint and fails
+	// admission if it can't be reached.
+	RemoteRuleValidationStrict RemoteRuleValidationMode = "strict"
+)
+
+// RemoteRuleValidationConfig configures ValidateRuleRemote's optional
+// live query validation. TokenSecretKeySelector follows the same
+// namespace/name/key selector shape used elsewhere in the monitoringv1
+// API for referencing bearer tokens held in a Secret.
+type RemoteRuleValidationConfig struct {
+	Mode                   RemoteRuleValidationMode
+	Endpoint               string
+	TokenSecretKeySelector *monitoringv1.SecretKeySelector
+	Timeout                time.Duration
+	AllowedNamespaces      []string
+	DeniedNamespaces       []string
+}
+
+// RegisterRemoteRuleValidationFlags registers the
+// --remote-rule-validation, --remote-rule-validation-url and
+// --remote-rule-validation-timeout operator flags, storing the parsed
+// values into cfg.
+func RegisterRemoteRuleValidationFlags(fs *flag.FlagSet, cfg *RemoteRuleValidationConfig) {
+	fs.Func("remote-rule-validation", "One of off, best-effort or strict. Controls whether rule admission also executes each expression against --remote-rule-validation-url.", func(v string) error {
+		switch RemoteRuleValidationMode(v) {
+		case RemoteRuleValidationOff, RemoteRuleValidationBestEffort, RemoteRuleValidationStrict:
+			cfg.Mode = RemoteRuleValidationMode(v)
+			return nil
+		default:
+			return fmt.Errorf("invalid --remote-rule-validation value %q, must be one of off, best-effort, strict", v)
+		}
+	})
+	fs.StringVar(&cfg.Endpoint, "remote-rule-validation-url", "", "Prometheus/Thanos Query API URL to validate rule expressions against. Required unless --remote-rule-validation=off.")
+	fs.DurationVar(&cfg.Timeout, "remote-rule-validation-timeout", 5*time.Second, "Per-rule timeout for remote rule validation queries.")
+}
+
+// namespaceAllowed reports whether ns is in scope for remote validation:
+// present in AllowedNamespaces (or that list is empty, meaning "all
+// namespaces") and absent from DeniedNamespaces.
+func (cfg RemoteRuleValidationConfig) namespaceAllowed(ns string) bool {
+	for _, denied := range cfg.DeniedNamespaces {
+		if denied == ns {
+			return false
+		}
+	}
+	if len(cfg.AllowedNamespaces) == 0 {
+		return true
+	}
+	for _, allowed := range cfg.AllowedNamespaces {
+		if allowed == ns {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoteRuleValidator executes rule expressions as instant queries
+// against a Prometheus/Thanos Query API to catch errors ValidateRule's
+// offline parser checks can't, such as a recording rule whose expression
+// conflicts with an existing label set on the server.
+type RemoteRuleValidator struct {
+	cfg    RemoteRuleValidationConfig
+	client apiv1.API
+}
+
+// NewRemoteRuleValidator builds a RemoteRuleValidator from cfg, sending
+// requests through roundTripper (typically one that attaches the bearer
+// token resolved from cfg.TokenSecretKeySelector). It returns (nil, nil)
+// when cfg.Mode is RemoteRuleValidationOff, since callers can then skip
+// remote validation entirely.
+func NewRemoteRuleValidator(cfg RemoteRuleValidationConfig, roundTripper http.RoundTripper) (*RemoteRuleValidator, error) {
+	if cfg.Mode == RemoteRuleValidationOff {
+		return nil, nil
+	}
+
+	c, err := api.NewClient(api.Config{Address: cfg.Endpoint, RoundTripper: roundTripper})
+	if err != nil {
+		return nil, fmt.Errorf("failed to build remote rule validation client: %w", err)
+	}
+
+	return &RemoteRuleValidator{cfg: cfg, client: apiv1.NewAPI(c)}, nil
+}
+
+// ValidateRuleRemote runs ValidateRule's offline checks and, when v is
+// non-nil, the configured namespace is in scope and the spec passed
+// offline validation, additionally executes each rule expression as an
+// instant query. For recording rules, it also compares the label set the
+// rule's static `labels` declare against the label set of any
+// already-recorded series with the same name, since a mismatch there
+// means two versions of the same recording rule are producing
+// differently-shaped series. Remote failures are reported through the
+// same `groups[i].rules[j]` field scheme as ValidateRule. If the
+// endpoint is unreachable, RemoteRuleValidationBestEffort falls back to
+// the offline result while RemoteRuleValidationStrict reports it as an
+// error.
+func ValidateRuleRemote(ctx context.Context, v *RemoteRuleValidator, namespace string, format RuleConfigurationFormat, ruleSpec monitoringv1.PrometheusRuleSpec, logger log.Logger) []admissionError {
+	errs := ValidateRule(format, ruleSpec)
+	if len(errs) != 0 || v == nil || v.cfg.Mode == RemoteRuleValidationOff || !v.cfg.namespaceAllowed(namespace) {
+		return errs
+	}
+
+	for i, group := range ruleSpec.Groups {
+		for j, rule := range group.Rules {
+			field := fmt.Sprintf("groups[%d].rules[%d]", i, j)
+
+			qCtx, cancel := context.WithTimeout(ctx, v.cfg.Timeout)
+			_, warnings, err := v.client.Query(qCtx, rule.Expr.String(), time.Now())
+			cancel()
+
+			if err != nil {
+				// A bad_data or execution error is the server rejecting the
+				// expression, not the endpoint being unreachable.
+				var apiErr *apiv1.Error
+				rejected := errors.As(err, &apiErr) && (apiErr.Type == apiv1.ErrBadData || apiErr.Type == apiv1.ErrExec)
+				if rejected || v.cfg.Mode == RemoteRuleValidationStrict {
+					errs = append(errs, newAdmissionError(field, fmt.Errorf("remote validation failed: %w", err)))
+				} else {
+					level.Warn(logger).Log("msg", "remote rule validation unreachable, falling back to offline result", "field", field, "err", err)
+				}
+				continue
+			}
+
+			for _, w := range warnings {
+				level.Warn(logger).Log("msg", "remote rule validation warning", "field", field, "warning", w)
+			}
+
+			if rule.Record == "" {
+				continue
+			}
+			if conflictErr := v.checkRecordingRuleLabelConflict(ctx, rule, field, logger); conflictErr != nil {
+				errs = append(errs, *conflictErr)
+			}
+		}
+	}
+
+	return errs
+}
+
+// checkRecordingRuleLabelConflict queries the existing series for
+// rule.Record and compares each one's label set (excluding __name__)
+// against the label set rule.Labels declares. A mismatch means this
+// rule's Labels would produce a differently-shaped series than what's
+// already being recorded under the same name, which Prometheus allows to
+// happen silently but which usually indicates the rule was edited
+// without considering the series already in flight. Returns nil if the
+// check can't be completed or no conflict is found.
+func (v *RemoteRuleValidator) checkRecordingRuleLabelConflict(ctx context.Context, rule monitoringv1.Rule, field string, logger log.Logger) *admissionError {
+	qCtx, cancel := context.WithTimeout(ctx, v.cfg.Timeout)
+	existing, _, err := v.client.Query(qCtx, rule.Record, time.Now())
+	cancel()
+	if err != nil {
+		level.Warn(logger).Log("msg", "failed to check recording rule label set against existing series", "field", field, "err", err)
+		return nil
+	}
+
+	vec, ok := existing.(model.Vector)
+	if !ok {
+		return nil
+	}
+
+	want := labelNames(rule.Labels)
+	for _, sample := range vec {
+		got := map[string]struct{}{}
+		for name := range sample.Metric {
+			if name == model.MetricNameLabel {
+				continue
+			}
+			got[string(name)] = struct{}{}
+		}
+
+		if !labelNameSetsEqual(want, got) {
+			return &admissionError{
+				Field: field,
+				err: fmt.Errorf(
+					"recording rule %q labels %v conflict with the label set %v of an already-recorded series",
+					rule.Record, sortedKeys(want), sortedKeys(got),
+				),
+			}
+		}
+	}
+
+	return nil
+}
+
+func labelNames(labels map[string]string) map[string]struct{} {
+	names := make(map[string]struct{}, len(labels))
+	for name := range labels {
+		names[name] = struct{}{}
+	}
+	return names
+}
+
+func labelNameSetsEqual(a, b map[string]struct{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name := range a {
+		if _, ok := b[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
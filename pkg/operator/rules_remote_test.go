@@ -0,0 +1,186 @@
+// Copyright 2022 The prometheus-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package operator
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+)
+
+func TestValidateRuleRemote(t *testing.T) {
+	t.Run("shouldSkipRemoteValidationWhenModeIsOff", shouldSkipRemoteValidationWhenModeIsOff)
+	t.Run("shouldAcceptRuleWhenRemoteQuerySucceeds", shouldAcceptRuleWhenRemoteQuerySucceeds)
+	t.Run("shouldFailStrictlyWhenEndpointUnreachable", shouldFailStrictlyWhenEndpointUnreachable)
+	t.Run("shouldFallBackWhenBestEffortAndEndpointUnreachable", shouldFallBackWhenBestEffortAndEndpointUnreachable)
+	t.Run("shouldSkipRemoteValidationOutsideAllowedNamespaces", shouldSkipRemoteValidationOutsideAllowedNamespaces)
+	t.Run("shouldFlagRecordingRuleLabelSetConflict", shouldFlagRecordingRuleLabelSetConflict)
+	t.Run("shouldAcceptRecordingRuleWithMatchingLabelSet", shouldAcceptRecordingRuleWithMatchingLabelSet)
+}
+
+func validRuleSpec() monitoringv1.PrometheusRuleSpec {
+	return monitoringv1.PrometheusRuleSpec{Groups: []monitoringv1.RuleGroup{
+		{
+			Name: "group",
+			Rules: []monitoringv1.Rule{
+				{
+					Alert: "alert",
+					Expr:  intstr.FromString("vector(1)"),
+				},
+			},
+		},
+	}}
+}
+
+func newTestValidator(t *testing.T, cfg RemoteRuleValidationConfig, rt http.RoundTripper) *RemoteRuleValidator {
+	t.Helper()
+	v, err := NewRemoteRuleValidator(cfg, rt)
+	if err != nil {
+		t.Fatalf("failed to build remote rule validator: %v", err)
+	}
+	return v
+}
+
+func shouldSkipRemoteValidationWhenModeIsOff(t *testing.T) {
+	v := newTestValidator(t, RemoteRuleValidationConfig{Mode: RemoteRuleValidationOff}, http.DefaultTransport)
+	if v != nil {
+		t.Fatalf("expected a nil validator when mode is off")
+	}
+
+	errs := ValidateRuleRemote(context.Background(), v, "default", PrometheusFormat, validRuleSpec(), log.NewLogfmtLogger(log.NewSyncWriter(os.Stdout)))
+	if len(errs) != 0 {
+		t.Fatalf("expected no errors, got %v", errs)
+	}
+}
+
+func shouldAcceptRuleWhenRemoteQuerySucceeds(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	defer srv.Close()
+
+	cfg := RemoteRuleValidationConfig{Mode: RemoteRuleValidationStrict, Endpoint: srv.URL, Timeout: time.Second}
+	v := newTestValidator(t, cfg, http.DefaultTransport)
+
+	errs := ValidateRuleRemote(context.Background(), v, "default", PrometheusFormat, validRuleSpec(), log.NewLogfmtLogger(log.NewSyncWriter(os.Stdout)))
+	if len(errs) != 0 {
+		t.Fatalf("expected no errors, got %v", errs)
+	}
+}
+
+func shouldFailStrictlyWhenEndpointUnreachable(t *testing.T) {
+	cfg := RemoteRuleValidationConfig{Mode: RemoteRuleValidationStrict, Endpoint: "http://127.0.0.1:1", Timeout: 100 * time.Millisecond}
+	v := newTestValidator(t, cfg, http.DefaultTransport)
+
+	errs := ValidateRuleRemote(context.Background(), v, "default", PrometheusFormat, validRuleSpec(), log.NewLogfmtLogger(log.NewSyncWriter(os.Stdout)))
+	if len(errs) == 0 {
+		t.Fatalf("expected an error when the remote endpoint is unreachable in strict mode")
+	}
+	if errs[0].Field != "groups[0].rules[0]" {
+		t.Fatalf("expected field groups[0].rules[0], got %s", errs[0].Field)
+	}
+}
+
+func shouldFallBackWhenBestEffortAndEndpointUnreachable(t *testing.T) {
+	cfg := RemoteRuleValidationConfig{Mode: RemoteRuleValidationBestEffort, Endpoint: "http://127.0.0.1:1", Timeout: 100 * time.Millisecond}
+	v := newTestValidator(t, cfg, http.DefaultTransport)
+
+	errs := ValidateRuleRemote(context.Background(), v, "default", PrometheusFormat, validRuleSpec(), log.NewLogfmtLogger(log.NewSyncWriter(os.Stdout)))
+	if len(errs) != 0 {
+		t.Fatalf("expected best-effort mode to fall back to the offline result, got %v", errs)
+	}
+}
+
+func shouldSkipRemoteValidationOutsideAllowedNamespaces(t *testing.T) {
+	cfg := RemoteRuleValidationConfig{
+		Mode:              RemoteRuleValidationStrict,
+		Endpoint:          "http://127.0.0.1:1",
+		Timeout:           100 * time.Millisecond,
+		AllowedNamespaces: []string{"monitoring"},
+	}
+	v := newTestValidator(t, cfg, http.DefaultTransport)
+
+	errs := ValidateRuleRemote(context.Background(), v, "default", PrometheusFormat, validRuleSpec(), log.NewLogfmtLogger(log.NewSyncWriter(os.Stdout)))
+	if len(errs) != 0 {
+		t.Fatalf("expected namespaces outside the allow-list to skip remote validation, got %v", errs)
+	}
+}
+
+func recordingRuleSpec(labels map[string]string) monitoringv1.PrometheusRuleSpec {
+	return monitoringv1.PrometheusRuleSpec{Groups: []monitoringv1.RuleGroup{
+		{
+			Name: "group",
+			Rules: []monitoringv1.Rule{
+				{
+					Record: "my:recording:rule",
+					Expr:   intstr.FromString("vector(1)"),
+					Labels: labels,
+				},
+			},
+		},
+	}}
+}
+
+// recordingRuleQueryServer returns a test server that answers the
+// initial `expr` instant query with an empty vector and the follow-up
+// `rule.Record` lookup with a single series carrying recordedLabels.
+func recordingRuleQueryServer(recordedLabels string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.FormValue("query") == "my:recording:rule" {
+			w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"my:recording:rule"` + recordedLabels + `},"value":[1,"1"]}]}}`))
+			return
+		}
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+}
+
+func shouldFlagRecordingRuleLabelSetConflict(t *testing.T) {
+	srv := recordingRuleQueryServer(`,"env":"prod","region":"us"`)
+	defer srv.Close()
+
+	cfg := RemoteRuleValidationConfig{Mode: RemoteRuleValidationStrict, Endpoint: srv.URL, Timeout: time.Second}
+	v := newTestValidator(t, cfg, http.DefaultTransport)
+
+	errs := ValidateRuleRemote(context.Background(), v, "default", PrometheusFormat, recordingRuleSpec(map[string]string{"env": "prod"}), log.NewLogfmtLogger(log.NewSyncWriter(os.Stdout)))
+	if len(errs) != 1 {
+		t.Fatalf("expected a single label-set conflict error, got %v", errs)
+	}
+	if errs[0].Field != "groups[0].rules[0]" {
+		t.Fatalf("expected field groups[0].rules[0], got %s", errs[0].Field)
+	}
+}
+
+func shouldAcceptRecordingRuleWithMatchingLabelSet(t *testing.T) {
+	srv := recordingRuleQueryServer(`,"env":"prod"`)
+	defer srv.Close()
+
+	cfg := RemoteRuleValidationConfig{Mode: RemoteRuleValidationStrict, Endpoint: srv.URL, Timeout: time.Second}
+	v := newTestValidator(t, cfg, http.DefaultTransport)
+
+	errs := ValidateRuleRemote(context.Background(), v, "default", PrometheusFormat, recordingRuleSpec(map[string]string{"env": "prod"}), log.NewLogfmtLogger(log.NewSyncWriter(os.Stdout)))
+	if len(errs) != 0 {
+		t.Fatalf("expected no errors when the label sets match, got %v", errs)
+	}
+}
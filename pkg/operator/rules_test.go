@@ -15,6 +15,7 @@
 package operator
 
 import (
+	"fmt"
 	"os"
 	"strings"
 	"testing"
@@ -32,7 +33,13 @@ func TestMakeRulesConfigMaps(t *testing.T) {
 	t.Run("shouldRejectRuleWithInvalidLabels", shouldRejectRuleWithInvalidLabels)
 	t.Run("shouldRejectRuleWithInvalidExpression", shouldRejectRuleWithInvalidExpression)
 	t.Run("shouldResetRuleWithPartialResponseStrategySet", shouldResetRuleWithPartialResponseStrategySet)
+	t.Run("shouldWrapLokiAndMimirRulesUnderTenant", shouldWrapLokiAndMimirRulesUnderTenant)
 	t.Run("validateFieldInAdmissionError", validateFieldInAdmissionError)
+	t.Run("shouldNotSplitConfigMapWhenUnderBudget", shouldNotSplitConfigMapWhenUnderBudget)
+	t.Run("shouldSplitConfigMapWhenGroupCountExceedsMax", shouldSplitConfigMapWhenGroupCountExceedsMax)
+	t.Run("shouldSplitConfigMapWhenByteBudgetExceeded", shouldSplitConfigMapWhenByteBudgetExceeded)
+	t.Run("shouldRejectGroupLargerThanBudget", shouldRejectGroupLargerThanBudget)
+	t.Run("shouldOrderConfigMapsDeterministicallyAcrossFiles", shouldOrderConfigMapsDeterministicallyAcrossFiles)
 }
 
 func shouldRejectRuleWithInvalidPartialResponseStrategyValue(t *testing.T) {
@@ -48,7 +55,7 @@ func shouldRejectRuleWithInvalidPartialResponseStrategyValue(t *testing.T) {
 			},
 		},
 	}}
-	_, err := generateRulesConfiguration(ThanosFormat, rules, log.NewLogfmtLogger(log.NewSyncWriter(os.Stdout)))
+	_, err := generateRulesConfiguration(ThanosFormat, "", rules, log.NewLogfmtLogger(log.NewSyncWriter(os.Stdout)))
 	if err == nil {
 		t.Fatalf("expected errors when parsing rule with invalid partial_response_strategy value")
 	}
@@ -67,7 +74,7 @@ func shouldAcceptRuleWithValidPartialResponseStrategyValue(t *testing.T) {
 			},
 		},
 	}}
-	content, _ := generateRulesConfiguration(ThanosFormat, rules, log.NewLogfmtLogger(log.NewSyncWriter(os.Stdout)))
+	content, _ := generateRulesConfiguration(ThanosFormat, "", rules, log.NewLogfmtLogger(log.NewSyncWriter(os.Stdout)))
 	if !strings.Contains(content, "partial_response_strategy: warn") {
 		t.Fatalf("expected `partial_response_strategy` to be set in PrometheusRule as `warn`")
 
@@ -89,7 +96,7 @@ func shouldAcceptValidRule(t *testing.T) {
 			},
 		},
 	}}
-	_, err := generateRulesConfiguration(PrometheusFormat, rules, log.NewLogfmtLogger(log.NewSyncWriter(os.Stdout)))
+	_, err := generateRulesConfiguration(PrometheusFormat, "", rules, log.NewLogfmtLogger(log.NewSyncWriter(os.Stdout)))
 	if err != nil {
 		t.Fatalf("expected no errors when parsing valid rule")
 	}
@@ -110,7 +117,7 @@ func shouldRejectRuleWithInvalidLabels(t *testing.T) {
 			},
 		},
 	}}
-	_, err := generateRulesConfiguration(PrometheusFormat, rules, log.NewLogfmtLogger(log.NewSyncWriter(os.Stdout)))
+	_, err := generateRulesConfiguration(PrometheusFormat, "", rules, log.NewLogfmtLogger(log.NewSyncWriter(os.Stdout)))
 	if err == nil {
 		t.Fatalf("expected errors when parsing rule with invalid labels")
 	}
@@ -128,7 +135,7 @@ func shouldRejectRuleWithInvalidExpression(t *testing.T) {
 			},
 		},
 	}}
-	_, err := generateRulesConfiguration(PrometheusFormat, rules, log.NewLogfmtLogger(log.NewSyncWriter(os.Stdout)))
+	_, err := generateRulesConfiguration(PrometheusFormat, "", rules, log.NewLogfmtLogger(log.NewSyncWriter(os.Stdout)))
 	if err == nil {
 		t.Fatalf("expected errors when parsing rule with invalid expression")
 	}
@@ -147,17 +154,71 @@ func shouldResetRuleWithPartialResponseStrategySet(t *testing.T) {
 			},
 		},
 	}}
-	content, _ := generateRulesConfiguration(PrometheusFormat, rules, log.NewLogfmtLogger(log.NewSyncWriter(os.Stdout)))
+	content, _ := generateRulesConfiguration(PrometheusFormat, "", rules, log.NewLogfmtLogger(log.NewSyncWriter(os.Stdout)))
 	if strings.Contains(content, "partial_response_strategy") {
 		t.Fatalf("expected `partial_response_strategy` removed from PrometheusRule")
 	}
 }
 
+func shouldWrapLokiAndMimirRulesUnderTenant(t *testing.T) {
+	for _, tc := range []struct {
+		format RuleConfigurationFormat
+		expr   string
+	}{
+		// Loki validates `expr` as LogQL, Mimir as PromQL.
+		{format: LokiRulerFormat, expr: `{app="foo"} |= "error"`},
+		{format: MimirRulerFormat, expr: "vector(1)"},
+	} {
+		format := tc.format
+		rules := monitoringv1.PrometheusRuleSpec{Groups: []monitoringv1.RuleGroup{
+			{
+				Name: "group",
+				Rules: []monitoringv1.Rule{
+					{
+						Alert: "alert",
+						Expr:  intstr.FromString(tc.expr),
+					},
+				},
+			},
+		}}
+
+		content, err := generateRulesConfiguration(format, "tenant-a", rules, log.NewLogfmtLogger(log.NewSyncWriter(os.Stdout)))
+		if err != nil {
+			t.Fatalf("expected no error for format %v, got %v", format, err)
+		}
+		if !strings.HasPrefix(content, "tenant-a:\n") {
+			t.Fatalf("expected format %v to be scoped under the tenant name, got %q", format, content)
+		}
+		if strings.HasPrefix(content, "groups:") {
+			t.Fatalf("expected format %v to not emit a bare `groups:` document like Prometheus/Thanos, got %q", format, content)
+		}
+	}
+
+	promContent, err := generateRulesConfiguration(PrometheusFormat, "tenant-a", monitoringv1.PrometheusRuleSpec{Groups: []monitoringv1.RuleGroup{
+		{
+			Name: "group",
+			Rules: []monitoringv1.Rule{
+				{
+					Alert: "alert",
+					Expr:  intstr.FromString("vector(1)"),
+				},
+			},
+		},
+	}}, log.NewLogfmtLogger(log.NewSyncWriter(os.Stdout)))
+	if err != nil {
+		t.Fatalf("expected no error for PrometheusFormat, got %v", err)
+	}
+	if !strings.HasPrefix(promContent, "groups:") {
+		t.Fatalf("expected PrometheusFormat to be unaffected by tenant, got %q", promContent)
+	}
+}
+
 func validateFieldInAdmissionError(t *testing.T) {
 	for _, tc := range []struct {
-		name          string
-		ruleSpec      monitoringv1.PrometheusRuleSpec
-		expectedField string
+		name             string
+		ruleSpec         monitoringv1.PrometheusRuleSpec
+		expectedField    string
+		expectedPosition bool
 	}{
 		{
 			name: "Invalid PartialResponseStrategy",
@@ -188,7 +249,8 @@ func validateFieldInAdmissionError(t *testing.T) {
 					},
 				},
 			}},
-			expectedField: "groups[0].rules[0]",
+			expectedField:    "groups[0].rules[0]",
+			expectedPosition: true,
 		},
 		{
 			name: "Invalid Rule in second rule",
@@ -207,7 +269,8 @@ func validateFieldInAdmissionError(t *testing.T) {
 					},
 				},
 			}},
-			expectedField: "groups[0].rules[1]",
+			expectedField:    "groups[0].rules[1]",
+			expectedPosition: true,
 		},
 		{
 			name: "Invalid Rule in second group",
@@ -231,7 +294,8 @@ func validateFieldInAdmissionError(t *testing.T) {
 					},
 				},
 			}},
-			expectedField: "groups[1].rules[0]",
+			expectedField:    "groups[1].rules[0]",
+			expectedPosition: true,
 		},
 		{
 			name: "Repeated group name",
@@ -259,7 +323,7 @@ func validateFieldInAdmissionError(t *testing.T) {
 		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
-			admissionErrors := ValidateRule(tc.ruleSpec)
+			admissionErrors := ValidateRule(PrometheusFormat, tc.ruleSpec)
 			if len(admissionErrors) == 0 {
 				t.Fatalf("expected errors when parsing invalid rule")
 			}
@@ -267,7 +331,162 @@ func validateFieldInAdmissionError(t *testing.T) {
 				if tc.expectedField != admissionError.Field {
 					t.Fatalf("field in admissionError doesn't match expected value: expected %s got %s", tc.expectedField, admissionError.Field)
 				}
+				hasPosition := admissionError.Line != 0 || admissionError.Column != 0
+				if hasPosition != tc.expectedPosition {
+					t.Fatalf("expected admissionError position info to be set=%v, got line=%d column=%d", tc.expectedPosition, admissionError.Line, admissionError.Column)
+				}
 			}
 		})
 	}
 }
+
+func TestValidateRuleYAML(t *testing.T) {
+	t.Run("shouldReportYAMLPositionForMultilineExprBlock", shouldReportYAMLPositionForMultilineExprBlock)
+}
+
+func shouldReportYAMLPositionForMultilineExprBlock(t *testing.T) {
+	raw := []byte(`groups:
+- name: group
+  rules:
+  - alert: alert
+    expr: |
+      sum(rate(http_requests_total[5m]))
+      (
+`)
+
+	errs := ValidateRuleYAML(PrometheusFormat, raw)
+	if len(errs) == 0 {
+		t.Fatalf("expected errors when parsing rule with invalid multi-line expr")
+	}
+
+	found := false
+	for _, err := range errs {
+		if err.Field != "groups[0].rules[0]" {
+			continue
+		}
+		found = true
+		// The stray "(" is on the second line of the expr block scalar,
+		// which itself starts on document line 6, so the error should be
+		// attributed to document line 7 - not line 2, which is where it'd
+		// land if the position were left relative to the isolated expr
+		// string.
+		if err.Line != 7 {
+			t.Fatalf("expected the invalid expr to be reported at document line 7, got %+v", err)
+		}
+		if err.Snippet != "(" {
+			t.Fatalf("expected the snippet to be the offending line of the document, got %+v", err)
+		}
+	}
+	if !found {
+		t.Fatalf("expected an error for groups[0].rules[0], got %+v", errs)
+	}
+}
+
+func ruleGroupWithRules(name string, n int) monitoringv1.RuleGroup {
+	group := monitoringv1.RuleGroup{Name: name}
+	for i := 0; i < n; i++ {
+		group.Rules = append(group.Rules, monitoringv1.Rule{
+			Alert: fmt.Sprintf("alert-%d", i),
+			Expr:  intstr.FromString("vector(1)"),
+		})
+	}
+	return group
+}
+
+func shouldNotSplitConfigMapWhenUnderBudget(t *testing.T) {
+	ruleFiles := map[string]monitoringv1.PrometheusRuleSpec{
+		"ns-rule.yaml": {Groups: []monitoringv1.RuleGroup{ruleGroupWithRules("group", 1)}},
+	}
+	cms, err := MakeRulesConfigMaps(PrometheusFormat, "", ruleFiles, RuleShardingOptions{}, log.NewLogfmtLogger(log.NewSyncWriter(os.Stdout)))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(cms) != 1 || cms[0].Key != "ns-rule.yaml" {
+		t.Fatalf("expected a single unsplit ConfigMap, got %+v", cms)
+	}
+}
+
+func shouldSplitConfigMapWhenGroupCountExceedsMax(t *testing.T) {
+	var groups []monitoringv1.RuleGroup
+	for i := 0; i < 5; i++ {
+		groups = append(groups, ruleGroupWithRules(fmt.Sprintf("group-%d", i), 1))
+	}
+	ruleFiles := map[string]monitoringv1.PrometheusRuleSpec{"ns-rule.yaml": {Groups: groups}}
+
+	opts := RuleShardingOptions{MaxRuleGroupsPerConfigMap: 2}
+	cms, err := MakeRulesConfigMaps(PrometheusFormat, "", ruleFiles, opts, log.NewLogfmtLogger(log.NewSyncWriter(os.Stdout)))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(cms) != 3 {
+		t.Fatalf("expected 5 groups capped at 2 per ConfigMap to split into 3 ConfigMaps, got %d", len(cms))
+	}
+}
+
+func shouldSplitConfigMapWhenByteBudgetExceeded(t *testing.T) {
+	ruleFiles := map[string]monitoringv1.PrometheusRuleSpec{
+		"ns-rule.yaml": {Groups: []monitoringv1.RuleGroup{
+			ruleGroupWithRules("group-0", 20),
+			ruleGroupWithRules("group-1", 20),
+		}},
+	}
+
+	single, err := MakeRulesConfigMaps(PrometheusFormat, "", map[string]monitoringv1.PrometheusRuleSpec{
+		"ns-rule.yaml": {Groups: []monitoringv1.RuleGroup{ruleGroupWithRules("group-0", 20)}},
+	}, RuleShardingOptions{}, log.NewLogfmtLogger(log.NewSyncWriter(os.Stdout)))
+	if err != nil || len(single) != 1 {
+		t.Fatalf("expected a single group to render into one ConfigMap, got %+v, %v", single, err)
+	}
+
+	// Room for either group on its own, but not for both together.
+	opts := RuleShardingOptions{MaxConfigMapDataSize: len(single[0].Content) * 3 / 2}
+	cms, err := MakeRulesConfigMaps(PrometheusFormat, "", ruleFiles, opts, log.NewLogfmtLogger(log.NewSyncWriter(os.Stdout)))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(cms) < 2 {
+		t.Fatalf("expected the byte budget to force a split into at least 2 ConfigMaps, got %d", len(cms))
+	}
+}
+
+func shouldRejectGroupLargerThanBudget(t *testing.T) {
+	ruleFiles := map[string]monitoringv1.PrometheusRuleSpec{
+		"ns-rule.yaml": {Groups: []monitoringv1.RuleGroup{ruleGroupWithRules("oversized", 50)}},
+	}
+
+	opts := RuleShardingOptions{MaxConfigMapDataSize: 100}
+	_, err := MakeRulesConfigMaps(PrometheusFormat, "", ruleFiles, opts, log.NewLogfmtLogger(log.NewSyncWriter(os.Stdout)))
+	if err == nil {
+		t.Fatalf("expected an error when a single group exceeds the ConfigMap budget")
+	}
+}
+
+func shouldOrderConfigMapsDeterministicallyAcrossFiles(t *testing.T) {
+	ruleFiles := map[string]monitoringv1.PrometheusRuleSpec{
+		"ns-c.yaml": {Groups: []monitoringv1.RuleGroup{ruleGroupWithRules("group-c", 1)}},
+		"ns-a.yaml": {Groups: []monitoringv1.RuleGroup{ruleGroupWithRules("group-a", 1)}},
+		"ns-b.yaml": {Groups: []monitoringv1.RuleGroup{ruleGroupWithRules("group-b", 1)}},
+	}
+
+	var keys []string
+	for i := 0; i < 10; i++ {
+		cms, err := MakeRulesConfigMaps(PrometheusFormat, "", ruleFiles, RuleShardingOptions{}, log.NewLogfmtLogger(log.NewSyncWriter(os.Stdout)))
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		var got []string
+		for _, cm := range cms {
+			got = append(got, cm.Key)
+		}
+		gotKeys := strings.Join(got, ",")
+
+		if keys == nil {
+			keys = got
+			continue
+		}
+		if strings.Join(keys, ",") != gotKeys {
+			t.Fatalf("expected MakeRulesConfigMaps to produce the same ConfigMap order across runs, got %v then %v", keys, got)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2022 The prometheus-operator Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package operator
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+)
+
+// ValidateRuleYAML runs ValidateRule against raw, the original YAML of a
+// PrometheusRuleSpec, and - unlike ValidateRule - fills in each
+// admissionError's Line, Column and Snippet from the position of the
+// offending node in raw. Rendered by RenderAdmissionWarnings, this lets
+// `kubectl apply` surface something like
+// `groups[0].rules[1]: 2:1: parse error: unexpected "(" (line 7, column 1: "(")`
+// pointing at the exact line of a multi-line `expr` block scalar, not
+// just the field path.
+//
+// If raw itself doesn't unmarshal into a PrometheusRuleSpec, a single
+// admissionError on the "groups" field is returned, with Line/Snippet
+// taken from the "line N:" position gopkg.in/yaml.v3 reports for the
+// malformed node.
+func ValidateRuleYAML(format RuleConfigurationFormat, raw []byte) []admissionError {
+	var spec monitoringv1.PrometheusRuleSpec
+	if err := yaml.Unmarshal(raw, &spec); err != nil {
+		admErr := newAdmissionError("groups", err)
+		if line, ok := yamlErrorLine(err); ok {
+			admErr.Line = line
+			admErr.Snippet = snippetAt(raw, line)
+		}
+		return []admissionError{admErr}
+	}
+
+	errs := ValidateRule(format, spec)
+	if len(errs) == 0 {
+		return nil
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(raw, &doc); err != nil || len(doc.Content) == 0 {
+		// The typed spec decoded fine, so report the field-only errors
+		// rather than fail validation outright over a node-walk problem.
+		return errs
+	}
+
+	for i := range errs {
+		node, isExpr := nodeForField(doc.Content[0], errs[i].Field)
+		if node == nil {
+			continue
+		}
+
+		if isExpr && errs[i].Line != 0 {
+			// errs[i].Line/Column were derived by parseErrPosition from the
+			// isolated `expr` string, so they're relative to the expression
+			// text, not to raw. A plain or quoted scalar's text starts on
+			// node's own line, and only that first line shares node's
+			// column offset. A `|`/`>` block scalar's node sits on the
+			// indicator, so its text starts on the following line; its
+			// columns are left relative to the expression text.
+			exprLine, exprColumn := errs[i].Line, errs[i].Column
+			firstLine := node.Line
+			if node.Style&(yaml.LiteralStyle|yaml.FoldedStyle) != 0 {
+				firstLine++
+			}
+			errs[i].Line = firstLine + exprLine - 1
+			if exprLine == 1 && firstLine == node.Line {
+				errs[i].Column = node.Column + exprColumn - 1
+			} else {
+				errs[i].Column = exprColumn
+			}
+			errs[i].Snippet = snippetAt(raw, errs[i].Line)
+			continue
+		}
+
+		if errs[i].Line == 0 {
+			errs[i].Line = node.Line
+		}
+		if errs[i].Column == 0 {
+			errs[i].Column = node.Column
+		}
+		if errs[i].Snippet == "" {
+			errs[i].Snippet = strings.TrimSpace(node.Value)
+		}
+	}
+
+	return errs
+}
+
+// RenderAdmissionWarnings formats errs as `kubectl apply`-facing warning
+// strings, one per error, suitable for an admission.Response's Warnings
+// (and, for the first error, its Result.Message).
+func RenderAdmissionWarnings(errs []admissionError) []string {
+	warnings := make([]string, 0, len(errs))
+	for _, e := range errs {
+		if e.Line == 0 {
+			warnings = append(warnings, fmt.Sprintf("%s: %s", e.Field, e.Error()))
+			continue
+		}
+		if e.Snippet == "" {
+			warnings = append(warnings, fmt.Sprintf("%s: %s (line %d, column %d)", e.Field, e.Error(), e.Line, e.Column))
+			continue
+		}
+		warnings = append(warnings, fmt.Sprintf("%s: %s (line %d, column %d: %q)", e.Field, e.Error(), e.Line, e.Column, e.Snippet))
+	}
+	return warnings
+}
+
+var fieldPathRe = regexp.MustCompile(`^groups\[(\d+)\](?:\.rules\[(\d+)\])?`)
+
+// nodeForField walks root, the document's top-level mapping, down to the
+// node responsible for field ("groups[i]" or "groups[i].rules[j]"),
+// preferring the rule's `expr` node when one is present. isExpr reports
+// whether the returned node is that `expr` node, which callers need to
+// know because an `expr` parse error's Line/Column are relative to the
+// expression text, not to the document.
+func nodeForField(root *yaml.Node, field string) (node *yaml.Node, isExpr bool) {
+	m := fieldPathRe.FindStringSubmatch(field)
+	if m == nil {
+		return nil, false
+	}
+
+	groups := mappingValue(root, "groups")
+	groupIndex, err := strconv.Atoi(m[1])
+	if groups == nil || err != nil || groupIndex >= len(groups.Content) {
+		return nil, false
+	}
+	group := groups.Content[groupIndex]
+
+	if m[2] == "" {
+		return group, false
+	}
+
+	rules := mappingValue(group, "rules")
+	ruleIndex, err := strconv.Atoi(m[2])
+	if rules == nil || err != nil || ruleIndex >= len(rules.Content) {
+		return group, false
+	}
+	rule := rules.Content[ruleIndex]
+
+	if expr := mappingValue(rule, "expr"); expr != nil {
+		return expr, true
+	}
+	return rule, false
+}
+
+// mappingValue returns the value node for key in the mapping node, or
+// nil if node isn't a mapping or doesn't contain key.
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+var yamlErrorLineRe = regexp.MustCompile(`line (\d+):`)
+
+// yamlErrorLine extracts the 1-based line number gopkg.in/yaml.v3 embeds
+// in its unmarshal error messages (e.g. "line 5: cannot unmarshal...").
+func yamlErrorLine(err error) (int, bool) {
+	m := yamlErrorLineRe.FindStringSubmatch(err.Error())
+	if m == nil {
+		return 0, false
+	}
+	line, convErr := strconv.Atoi(m[1])
+	return line, convErr == nil
+}
+
+// snippetAt returns line (1-based) of raw, trimmed of surrounding
+// whitespace, or "" if out of range.
+func snippetAt(raw []byte, line int) string {
+	lines := strings.Split(string(raw), "\n")
+	if line < 1 || line > len(lines) {
+		return ""
+	}
+	return strings.TrimSpace(lines[line-1])
+}